@@ -9,6 +9,8 @@ package webserver
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/dgraph-io/badger/v2"
@@ -21,8 +23,101 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 )
 
+// Number of keys between ctx.Done() checks in a Badger iterator loop.
+const ctxCheckInterval = 1000
+
+// contextFromRequest wraps request.Context() with a deadline from ?timeout=, if given.
+func contextFromRequest(request *http.Request) (context.Context, context.CancelFunc) {
+	timeoutStr := request.URL.Query().Get("timeout")
+	if timeoutStr == "" {
+		return request.Context(), func() {}
+	}
+	timeout, err := time.ParseDuration(timeoutStr)
+	if err != nil {
+		glog.Warningf("Ignoring invalid timeout param %q: %v", timeoutStr, err)
+		return request.Context(), func() {}
+	}
+	return context.WithTimeout(request.Context(), timeout)
+}
+
+const (
+	partialHeader = "X-Sloop-Partial"
+	lastKeyHeader = "X-Sloop-Last-Key"
+)
+
+func markPartial(writer http.ResponseWriter, lastKey string) {
+	writer.Header().Set(partialHeader, "true")
+	writer.Header().Set(lastKeyHeader, lastKey)
+}
+
+// markPartialTrailer is markPartial for a response whose headers were already sent.
+func markPartialTrailer(writer http.ResponseWriter, lastKey string) {
+	writer.Header().Set(http.TrailerPrefix+partialHeader, "true")
+	writer.Header().Set(http.TrailerPrefix+lastKeyHeader, lastKey)
+}
+
+func decodeContinuationToken(token string) (string, []byte, error) {
+	if token == "" {
+		return "", nil, nil
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("malformed continuation token")
+	}
+	table, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", nil, err
+	}
+	key, err := base64.URLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, err
+	}
+	return string(table), key, nil
+}
+
+// The table travels with the key because table=all scans tables in a fixed
+// order that isn't lexical key order, so resuming by key alone can Seek back
+// into an already-drained table and re-emit it.
+func encodeContinuationToken(table string, key []byte) string {
+	return base64.URLEncoding.EncodeToString([]byte(table)) + "." + base64.URLEncoding.EncodeToString(key)
+}
+
+// resumeTableIndex returns afterTable's position in tablesToSearch, or -1 if there isn't one.
+func resumeTableIndex(tablesToSearch []string, afterTable string) int {
+	if afterTable == "" {
+		return -1
+	}
+	for i, tablename := range tablesToSearch {
+		if tablename == afterTable {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextPageLink rebuilds the requested URL with ?after= set to token.
+func nextPageLink(request *http.Request, token string) string {
+	values := request.URL.Query()
+	values.Set("after", token)
+	nextURL := *request.URL
+	nextURL.RawQuery = values.Encode()
+	return nextURL.String()
+}
+
+func writeNDJSONLine(writer http.ResponseWriter, key string) error {
+	line, err := json.Marshal(struct {
+		Key string `json:"key"`
+	}{Key: key})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(line, '\n'))
+	return err
+}
+
 type keyView struct {
 	Key        string
 	Payload    template.HTML
@@ -42,10 +137,22 @@ func jsonPrettyPrint(in string) string {
 	return out.String()
 }
 
+func wantsJSON(request *http.Request) bool {
+	if cleanStringFromParam(request, "format", "") == "json" {
+		return true
+	}
+	return strings.Contains(request.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(writer http.ResponseWriter, request *http.Request, data interface{}) {
+	writer.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(writer).Encode(data); err != nil {
+		logWebError(err, "Failed to encode JSON response", request, writer)
+	}
+}
+
 func viewKeyHandler(tables typed.Tables) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
-		writer.Header().Set("content-type", "text/html")
-
 		key := request.FormValue("k")
 		data := keyView{}
 		data.Key = key
@@ -96,6 +203,12 @@ func viewKeyHandler(tables typed.Tables) http.HandlerFunc {
 		}
 		data.Payload = template.HTML(string(prettyJson))
 
+		if wantsJSON(request) {
+			writeJSON(writer, request, data)
+			return
+		}
+
+		writer.Header().Set("content-type", "text/html")
 		debugViewKeyTemplate, err := getTemplate(debugViewKeyTemplateFile, _webfiles_debugviewkey_html)
 		if err != nil {
 			logWebError(err, "failed to parse template", request, writer)
@@ -111,8 +224,12 @@ func viewKeyHandler(tables typed.Tables) http.HandlerFunc {
 
 func listKeysHandler(tables typed.Tables) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx, cancel := contextFromRequest(request)
+		defer cancel()
+
 		table := cleanStringFromParam(request, "table", "")
 		maxRows := numberFromParam(request, "maxrows", 1000)
+		pageSize := numberFromParam(request, "pageSize", maxRows)
 		searchOption := cleanStringFromParam(request, "searchOption", "")
 		regexSearch := searchOption == "regex"
 		var lookBack int
@@ -129,6 +246,13 @@ func listKeysHandler(tables typed.Tables) http.HandlerFunc {
 			lookBack = numberFromParam(request, "lookback", 336)
 			keySearch = request.URL.Query().Get("urlmatch")
 		}
+
+		afterTable, afterKey, err := decodeContinuationToken(request.URL.Query().Get("after"))
+		if err != nil {
+			logWebError(err, "Invalid after token", request, writer)
+			return
+		}
+
 		var keys []string
 
 		count := 0
@@ -142,9 +266,29 @@ func listKeysHandler(tables typed.Tables) http.HandlerFunc {
 			tablesToSearch = append(tablesToSearch, table)
 		}
 
+		resumeIndex := resumeTableIndex(tablesToSearch, afterTable)
+
+		partial := false
+		lastKey := ""
+		nextToken := ""
+
+		streamNDJSON := regexSearch && strings.Contains(request.Header.Get("Accept"), "application/x-ndjson")
+		var flusher http.Flusher
+		if streamNDJSON {
+			flusher, _ = writer.(http.Flusher)
+			writer.Header().Set("content-type", "application/x-ndjson")
+		}
+
 		err = tables.Db().View(func(txn badgerwrap.Txn) error {
 			if regexSearch {
-				for _, tablename := range tablesToSearch {
+			regexTables:
+				for i, tablename := range tablesToSearch {
+					// A table whose position comes before the continuation
+					// token's table was fully drained on an earlier page.
+					if resumeIndex >= 0 && i < resumeIndex {
+						continue
+					}
+
 					keyPrefix := ""
 					if tablename != "internal" {
 						keyPrefix = "/" + tablename + "/"
@@ -157,17 +301,45 @@ func listKeysHandler(tables typed.Tables) http.HandlerFunc {
 					itr := txn.NewIterator(iterOpt)
 					defer itr.Close()
 
-					// TODO: Investigate if Seek() can be used instead of rewind
-					for itr.Rewind(); itr.ValidForPrefix([]byte(keyPrefix)); itr.Next() {
+					if resumeIndex >= 0 && i == resumeIndex && len(afterKey) > 0 {
+						itr.Seek(afterKey)
+						if itr.ValidForPrefix([]byte(keyPrefix)) && bytes.Equal(itr.Item().Key(), afterKey) {
+							itr.Next()
+						}
+					} else {
+						itr.Rewind()
+					}
+
+					for ; itr.ValidForPrefix([]byte(keyPrefix)); itr.Next() {
 						totalCount++
-						thisKey := string(itr.Item().Key())
+						item := itr.Item()
+						thisKey := string(item.Key())
+						lastKey = thisKey
+						if totalCount%ctxCheckInterval == 0 {
+							select {
+							case <-ctx.Done():
+								glog.Infof("listKeysHandler cancelled after %v keys: %v", totalCount, ctx.Err())
+								partial = true
+								break regexTables
+							default:
+							}
+						}
 						if keyRegEx.MatchString(thisKey) {
-							keys = append(keys, thisKey)
 							count += 1
-							totalSize += itr.Item().EstimatedSize()
-							if count >= maxRows {
-								glog.Infof("Number of rows : %v has reached max rows: %v", count, maxRows)
-								break
+							totalSize += item.EstimatedSize()
+							if streamNDJSON {
+								if werr := writeNDJSONLine(writer, thisKey); werr != nil {
+									return errors.Wrap(werr, "failed to stream key")
+								}
+								if flusher != nil {
+									flusher.Flush()
+								}
+							} else {
+								keys = append(keys, thisKey)
+							}
+							if count >= pageSize {
+								nextToken = encodeContinuationToken(tablename, item.KeyCopy(nil))
+								break regexTables
 							}
 						}
 					}
@@ -177,16 +349,16 @@ func listKeysHandler(tables typed.Tables) http.HandlerFunc {
 					switch tablename {
 					case "watch":
 						key := &typed.WatchTableKey{}
-						keys = append(keys, tables.WatchTable().GetAllKeysForGivenPartitions(tables.Db(), key, maxRows, lookBack, keySearch)...)
+						keys = append(keys, tables.WatchTable().GetAllKeysForGivenPartitions(ctx, tables.Db(), key, maxRows, lookBack, keySearch)...)
 					case "eventcount":
 						key := &typed.EventCountKey{}
-						keys = append(keys, tables.EventCountTable().GetAllKeysForGivenPartitions(tables.Db(), key, maxRows, lookBack, keySearch)...)
+						keys = append(keys, tables.EventCountTable().GetAllKeysForGivenPartitions(ctx, tables.Db(), key, maxRows, lookBack, keySearch)...)
 					case "ressum":
 						key := &typed.ResourceSummaryKey{}
-						keys = append(keys, tables.ResourceSummaryTable().GetAllKeysForGivenPartitions(tables.Db(), key, maxRows, lookBack, keySearch)...)
+						keys = append(keys, tables.ResourceSummaryTable().GetAllKeysForGivenPartitions(ctx, tables.Db(), key, maxRows, lookBack, keySearch)...)
 					case "watchactivity":
 						key := &typed.WatchActivityKey{}
-						keys = append(keys, tables.WatchActivityTable().GetAllKeysForGivenPartitions(tables.Db(), key, maxRows, lookBack, keySearch)...)
+						keys = append(keys, tables.WatchActivityTable().GetAllKeysForGivenPartitions(ctx, tables.Db(), key, maxRows, lookBack, keySearch)...)
 					}
 				}
 				count = len(keys)
@@ -196,24 +368,54 @@ func listKeysHandler(tables typed.Tables) http.HandlerFunc {
 			return nil
 		})
 		if err != nil {
+			if streamNDJSON {
+				glog.Errorf("listKeysHandler: %v", err)
+				return
+			}
 			logWebError(err, "Could not list keys", request, writer)
 			return
 		}
 
-		writer.Header().Set("content-type", "text/html")
-
-		debugListKeysTemplate, err := getTemplate(debugListKeysTemplateFile, _webfiles_debuglistkeys_html)
-		if err != nil {
-			logWebError(err, "failed to parse template", request, writer)
+		if streamNDJSON {
+			// The body is already flushed, so anything learned during the
+			// scan can only be delivered as an HTTP trailer at this point.
+			if partial {
+				markPartialTrailer(writer, lastKey)
+			}
+			if nextToken != "" {
+				writer.Header().Set(http.TrailerPrefix+"Link", nextPageLink(request, nextToken))
+			}
 			return
 		}
 
+		if partial {
+			markPartial(writer, lastKey)
+		}
+
+		if nextToken != "" {
+			writer.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextPageLink(request, nextToken)))
+		}
+
 		//To-do: Fix the Total Size of Matched Keys and Keys Searched for Partition search
 		var result keysData
 		result.Keys = keys
 		result.TotalKeys = totalCount
 		result.TotalSize = totalSize
 		result.KeysMatched = count
+
+		if wantsJSON(request) {
+			writeJSON(writer, request, result)
+			return
+		}
+
+		writer.Header().Set("content-type", "text/html")
+
+		debugListKeysTemplate, err := getTemplate(debugListKeysTemplateFile, _webfiles_debuglistkeys_html)
+		if err != nil {
+			logWebError(err, "failed to parse template", request, writer)
+			return
+		}
+
 		err = debugListKeysTemplate.Execute(writer, result)
 		if err != nil {
 			logWebError(err, "Template.ExecuteTemplate failed", request, writer)
@@ -243,6 +445,46 @@ type histogram struct {
 	TotalDiscardKeys      int
 }
 
+// histogramEntry flattens a HistogramMap entry into a (key, info) pair, since
+// common.SloopKey is a struct and encoding/json can't marshal a map keyed by one.
+type histogramEntry struct {
+	Key  common.SloopKey
+	Info *sloopKeyInfo
+}
+
+func (h histogram) MarshalJSON() ([]byte, error) {
+	entries := make([]histogramEntry, 0, len(h.HistogramMap))
+	for key, info := range h.HistogramMap {
+		entries = append(entries, histogramEntry{Key: key, Info: info})
+	}
+
+	type histogramAlias struct {
+		HistogramMap          []histogramEntry
+		TotalKeys             int
+		TotalSloopKeys        int
+		TotalEstimatedSize    int64
+		DeletedKeys           int
+		TotalInternalKeys     int
+		TotalInternalKeysSize int64
+		TotalHeadKeys         int
+		TotalMoveKeys         int
+		TotalDiscardKeys      int
+	}
+
+	return json.Marshal(histogramAlias{
+		HistogramMap:          entries,
+		TotalKeys:             h.TotalKeys,
+		TotalSloopKeys:        h.TotalSloopKeys,
+		TotalEstimatedSize:    h.TotalEstimatedSize,
+		DeletedKeys:           h.DeletedKeys,
+		TotalInternalKeys:     h.TotalInternalKeys,
+		TotalInternalKeysSize: h.TotalInternalKeysSize,
+		TotalHeadKeys:         h.TotalHeadKeys,
+		TotalMoveKeys:         h.TotalMoveKeys,
+		TotalDiscardKeys:      h.TotalDiscardKeys,
+	})
+}
+
 type keysData struct {
 	Keys        []string
 	TotalKeys   int
@@ -250,97 +492,134 @@ type keysData struct {
 	KeysMatched int
 }
 
-func histogramHandler(tables typed.Tables) http.HandlerFunc {
-	return func(writer http.ResponseWriter, request *http.Request) {
-		var result histogram
-		prefix := request.URL.Query().Get("prefix")
-		if len(prefix) > 0 {
+// computeKeyHistogram is shared by histogramHandler and metricsHandler. A
+// cancelled or expired ctx stops the scan early and returns a partial result.
+func computeKeyHistogram(ctx context.Context, tables typed.Tables, prefix string) (histogram, bool, string, error) {
+	var result histogram
+	partial := false
+	lastKey := ""
 
-			if prefix == "*" {
-				prefix = ""
-			}
+	if prefix == "*" {
+		prefix = ""
+	}
 
-			err := tables.Db().View(func(txn badgerwrap.Txn) error {
-				iterOpt := badger.DefaultIteratorOptions
-				iterOpt.Prefix = []byte(prefix)
-				iterOpt.PrefetchValues = false
-				iterOpt.AllVersions = true
-				iterOpt.InternalAccess = true
-				itr := txn.NewIterator(iterOpt)
-				defer itr.Close()
-
-				totalKeys := 0
-				var totalEstimatedSize int64 = 0
-				var totalInternalKeysSize int64 = 0
-				totalDeletedExpiredKeys := 0
-				totalInternalKeys := 0
-				totalMoveKeys := 0
-				totalHeadKeys := 0
-				totalDiscardKeys := 0
-				totalSloopKeys := 0
-				var sloopMap = make(map[common.SloopKey]*sloopKeyInfo)
-				for itr.Rewind(); itr.Valid(); itr.Next() {
-					item := itr.Item()
-					size := item.EstimatedSize()
-					totalEstimatedSize += size
-					totalKeys++
-					if item.IsDeletedOrExpired() {
-						totalDeletedExpiredKeys++
-					}
+	err := tables.Db().View(func(txn badgerwrap.Txn) error {
+		iterOpt := badger.DefaultIteratorOptions
+		iterOpt.Prefix = []byte(prefix)
+		iterOpt.PrefetchValues = false
+		iterOpt.AllVersions = true
+		iterOpt.InternalAccess = true
+		itr := txn.NewIterator(iterOpt)
+		defer itr.Close()
+
+		totalKeys := 0
+		var totalEstimatedSize int64 = 0
+		var totalInternalKeysSize int64 = 0
+		totalDeletedExpiredKeys := 0
+		totalInternalKeys := 0
+		totalMoveKeys := 0
+		totalHeadKeys := 0
+		totalDiscardKeys := 0
+		totalSloopKeys := 0
+		var sloopMap = make(map[common.SloopKey]*sloopKeyInfo)
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			item := itr.Item()
+			lastKey = string(item.Key())
+			if totalKeys > 0 && totalKeys%ctxCheckInterval == 0 {
+				select {
+				case <-ctx.Done():
+					glog.Infof("computeKeyHistogram cancelled after %v keys: %v", totalKeys, ctx.Err())
+					partial = true
+				default:
+				}
+			}
+			if partial {
+				break
+			}
+			size := item.EstimatedSize()
+			totalEstimatedSize += size
+			totalKeys++
+			if item.IsDeletedOrExpired() {
+				totalDeletedExpiredKeys++
+			}
 
-					if strings.HasPrefix(string(item.Key()), "!badger") {
-						totalInternalKeys++
-						totalInternalKeysSize += item.EstimatedSize()
-						if strings.HasPrefix(string(item.Key()), "!badger!head") {
-							totalHeadKeys++
-						} else if strings.HasPrefix(string(item.Key()), "!badger!move") {
-							totalMoveKeys++
-						} else if strings.HasPrefix(string(item.Key()), "!badger!discard") {
-							totalDiscardKeys++
-						}
-					} else {
-						totalSloopKeys++
-						sloopKey, err := common.GetSloopKey(item)
-						if err != nil {
-							return errors.Wrapf(err, "failed to parse information about key: %x",
-								item.Key())
-						}
+			if strings.HasPrefix(string(item.Key()), "!badger") {
+				totalInternalKeys++
+				totalInternalKeysSize += item.EstimatedSize()
+				if strings.HasPrefix(string(item.Key()), "!badger!head") {
+					totalHeadKeys++
+				} else if strings.HasPrefix(string(item.Key()), "!badger!move") {
+					totalMoveKeys++
+				} else if strings.HasPrefix(string(item.Key()), "!badger!discard") {
+					totalDiscardKeys++
+				}
+			} else {
+				totalSloopKeys++
+				sloopKey, err := common.GetSloopKey(item)
+				if err != nil {
+					return errors.Wrapf(err, "failed to parse information about key: %x",
+						item.Key())
+				}
 
-						if sloopMap[sloopKey] == nil {
-							sloopMap[sloopKey] = &sloopKeyInfo{size, size, 1, size, size}
-						} else {
-							sloopMap[sloopKey].TotalKeys++
-							sloopMap[sloopKey].TotalSize += size
-							sloopMap[sloopKey].AverageSize = sloopMap[sloopKey].TotalSize / sloopMap[sloopKey].TotalKeys
-							if size < sloopMap[sloopKey].MinimumSize {
-								sloopMap[sloopKey].MinimumSize = size
-							}
+				if sloopMap[sloopKey] == nil {
+					sloopMap[sloopKey] = &sloopKeyInfo{size, size, 1, size, size}
+				} else {
+					sloopMap[sloopKey].TotalKeys++
+					sloopMap[sloopKey].TotalSize += size
+					sloopMap[sloopKey].AverageSize = sloopMap[sloopKey].TotalSize / sloopMap[sloopKey].TotalKeys
+					if size < sloopMap[sloopKey].MinimumSize {
+						sloopMap[sloopKey].MinimumSize = size
+					}
 
-							if size > sloopMap[sloopKey].MaximumSize {
-								sloopMap[sloopKey].MaximumSize = size
-							}
-						}
+					if size > sloopMap[sloopKey].MaximumSize {
+						sloopMap[sloopKey].MaximumSize = size
 					}
 				}
+			}
+		}
 
-				result.TotalKeys = totalKeys
-				result.DeletedKeys = totalDeletedExpiredKeys
-				result.HistogramMap = sloopMap
-				result.TotalDiscardKeys = totalDiscardKeys
-				result.TotalEstimatedSize = totalEstimatedSize
-				result.TotalHeadKeys = totalHeadKeys
-				result.TotalInternalKeys = totalInternalKeys
-				result.TotalMoveKeys = totalMoveKeys
-				result.TotalInternalKeysSize = totalInternalKeysSize
-				result.TotalSloopKeys = totalSloopKeys
-				return nil
-			})
+		result.TotalKeys = totalKeys
+		result.DeletedKeys = totalDeletedExpiredKeys
+		result.HistogramMap = sloopMap
+		result.TotalDiscardKeys = totalDiscardKeys
+		result.TotalEstimatedSize = totalEstimatedSize
+		result.TotalHeadKeys = totalHeadKeys
+		result.TotalInternalKeys = totalInternalKeys
+		result.TotalMoveKeys = totalMoveKeys
+		result.TotalInternalKeysSize = totalInternalKeysSize
+		result.TotalSloopKeys = totalSloopKeys
+		return nil
+	})
+
+	return result, partial, lastKey, err
+}
 
+func histogramHandler(tables typed.Tables) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx, cancel := contextFromRequest(request)
+		defer cancel()
+
+		var result histogram
+		partial := false
+		lastKey := ""
+		prefix := request.URL.Query().Get("prefix")
+		if len(prefix) > 0 {
+			var err error
+			result, partial, lastKey, err = computeKeyHistogram(ctx, tables, prefix)
 			if err != nil {
 				logWebError(err, "Could not get histogram", request, writer)
 				return
 			}
 		}
+		if partial {
+			markPartial(writer, lastKey)
+		}
+
+		if wantsJSON(request) {
+			writeJSON(writer, request, result)
+			return
+		}
+
 		writer.Header().Set("content-type", "text/html")
 
 		debugHistogramTemplate, err := getTemplate(debugHistogramFile, _webfiles_debughistogram_html)
@@ -358,6 +637,11 @@ func histogramHandler(tables typed.Tables) http.HandlerFunc {
 
 func configHandler(config string) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
+		if wantsJSON(request) {
+			writeJSON(writer, request, config)
+			return
+		}
+
 		debugConfigTemplate, err := getTemplate(debugConfigTemplateFile, _webfiles_debugconfig_html)
 		if err != nil {
 			logWebError(err, "failed to parse template", request, writer)
@@ -398,11 +682,6 @@ type badgerTableInfo struct {
 
 func debugBadgerTablesHandler(db badgerwrap.DB) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
-		debugBadgerTablesTemplate, err := getTemplate(debugBadgerTablesTemplateFile, _webfiles_debugtables_html)
-		if err != nil {
-			logWebError(err, "failed to parse template", request, writer)
-			return
-		}
 		data := []badgerTableInfo{}
 		for _, table := range db.Tables(true) {
 			thisTable := badgerTableInfo{
@@ -415,6 +694,17 @@ func debugBadgerTablesHandler(db badgerwrap.DB) http.HandlerFunc {
 			}
 			data = append(data, thisTable)
 		}
+
+		if wantsJSON(request) {
+			writeJSON(writer, request, data)
+			return
+		}
+
+		debugBadgerTablesTemplate, err := getTemplate(debugBadgerTablesTemplateFile, _webfiles_debugtables_html)
+		if err != nil {
+			logWebError(err, "failed to parse template", request, writer)
+			return
+		}
 		err = debugBadgerTablesTemplate.Execute(writer, data)
 		if err != nil {
 			logWebError(err, "Template.ExecuteTemplate failed", request, writer)
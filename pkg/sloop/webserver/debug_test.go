@@ -0,0 +1,273 @@
+/*
+ * Copyright (c) 2019, salesforce.com, inc.
+ * All rights reserved.
+ * SPDX-License-Identifier: BSD-3-Clause
+ * For full license text, see LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+ */
+
+package webserver
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/salesforce/sloop/pkg/sloop/common"
+)
+
+func TestContinuationTokenRoundTrip(t *testing.T) {
+	table, key, err := decodeContinuationToken(encodeContinuationToken("watch", []byte("/watch/abc")))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if table != "watch" || string(key) != "/watch/abc" {
+		t.Fatalf("got table=%q key=%q, want table=watch key=/watch/abc", table, key)
+	}
+}
+
+func TestDecodeContinuationTokenEmpty(t *testing.T) {
+	table, key, err := decodeContinuationToken("")
+	if err != nil || table != "" || key != nil {
+		t.Fatalf("decodeContinuationToken(\"\") = (%q, %v, %v), want (\"\", nil, nil)", table, key, err)
+	}
+}
+
+func TestDecodeContinuationTokenMalformed(t *testing.T) {
+	if _, _, err := decodeContinuationToken("not-a-valid-token"); err == nil {
+		t.Fatal("expected an error decoding a malformed token")
+	}
+}
+
+func TestNextPageLink(t *testing.T) {
+	request := httptest.NewRequest("GET", "/debug/listkeys?table=all&searchOption=regex&keymatch=foo", nil)
+	token := encodeContinuationToken("watch", []byte("/watch/abc"))
+
+	link := nextPageLink(request, token)
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("nextPageLink produced an unparseable URL: %v", err)
+	}
+	if got := parsed.Query().Get("after"); got != token {
+		t.Fatalf("after param = %q, want %q", got, token)
+	}
+	if got := parsed.Query().Get("keymatch"); got != "foo" {
+		t.Fatalf("expected existing query params to be preserved, got keymatch=%q", got)
+	}
+}
+
+func TestContextFromRequestNoTimeout(t *testing.T) {
+	request := httptest.NewRequest("GET", "/debug/listkeys", nil)
+	ctx, cancel := contextFromRequest(request)
+	defer cancel()
+
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("expected no deadline when ?timeout= is absent")
+	}
+}
+
+func TestContextFromRequestValidTimeout(t *testing.T) {
+	request := httptest.NewRequest("GET", "/debug/listkeys?timeout=50ms", nil)
+	before := time.Now()
+	ctx, cancel := contextFromRequest(request)
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatal("expected a deadline when ?timeout= is valid")
+	}
+	if got := deadline.Sub(before); got < 40*time.Millisecond || got > time.Second {
+		t.Fatalf("deadline %v from now, want roughly 50ms", got)
+	}
+}
+
+func TestContextFromRequestInvalidTimeout(t *testing.T) {
+	request := httptest.NewRequest("GET", "/debug/listkeys?timeout=not-a-duration", nil)
+	ctx, cancel := contextFromRequest(request)
+	defer cancel()
+
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("expected an invalid ?timeout= to be ignored rather than applied")
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	cases := []struct {
+		name   string
+		url    string
+		accept string
+		want   bool
+	}{
+		{"format=json param", "/debug/listkeys?format=json", "", true},
+		{"accept header", "/debug/listkeys", "application/json", true},
+		{"accept header with charset", "/debug/listkeys", "application/json; charset=utf-8", true},
+		{"neither", "/debug/listkeys", "", false},
+		{"accept html", "/debug/listkeys", "text/html", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", c.url, nil)
+			if c.accept != "" {
+				request.Header.Set("Accept", c.accept)
+			}
+			if got := wantsJSON(request); got != c.want {
+				t.Fatalf("wantsJSON() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	request := httptest.NewRequest("GET", "/debug/listkeys?format=json", nil)
+	recorder := httptest.NewRecorder()
+
+	writeJSON(recorder, request, keysData{Keys: []string{"/watch/a"}, TotalKeys: 1})
+
+	if ct := recorder.Header().Get("content-type"); ct != "application/json" {
+		t.Fatalf("content-type = %q, want application/json", ct)
+	}
+
+	var got keysData
+	if err := json.Unmarshal(recorder.Body.Bytes(), &got); err != nil {
+		t.Fatalf("response body did not decode as JSON: %v", err)
+	}
+	if len(got.Keys) != 1 || got.Keys[0] != "/watch/a" || got.TotalKeys != 1 {
+		t.Fatalf("got %+v, want Keys=[/watch/a] TotalKeys=1", got)
+	}
+}
+
+func TestHistogramMarshalJSON(t *testing.T) {
+	key := common.SloopKey{Table: "watch", Partition: "p1", Group: "g1", Kind: "k1", Namespace: "n1"}
+	h := histogram{
+		HistogramMap: map[common.SloopKey]*sloopKeyInfo{
+			key: {MinimumSize: 1, MaximumSize: 2, TotalKeys: 3, TotalSize: 4, AverageSize: 1},
+		},
+		TotalKeys:      10,
+		TotalSloopKeys: 3,
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		t.Fatalf("json.Marshal(histogram): %v", err)
+	}
+
+	var decoded struct {
+		HistogramMap []histogramEntry
+		TotalKeys    int
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("decoding marshaled histogram: %v", err)
+	}
+	if decoded.TotalKeys != 10 {
+		t.Fatalf("TotalKeys = %d, want 10", decoded.TotalKeys)
+	}
+	if len(decoded.HistogramMap) != 1 {
+		t.Fatalf("HistogramMap entries = %d, want 1", len(decoded.HistogramMap))
+	}
+	entry := decoded.HistogramMap[0]
+	if entry.Key != key {
+		t.Fatalf("entry.Key = %+v, want %+v", entry.Key, key)
+	}
+	if entry.Info.TotalKeys != 3 {
+		t.Fatalf("entry.Info.TotalKeys = %d, want 3", entry.Info.TotalKeys)
+	}
+}
+
+func TestResumeTableIndex(t *testing.T) {
+	tablesToSearch := []string{"watch", "eventcount", "ressum", "watchactivity"}
+
+	cases := []struct {
+		name       string
+		afterTable string
+		want       int
+	}{
+		{"first page", "", -1},
+		{"resume mid list", "eventcount", 1},
+		{"resume last table", "watchactivity", 3},
+		{"stale table no longer searched", "nosuchtable", -1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := resumeTableIndex(tablesToSearch, c.afterTable); got != c.want {
+				t.Fatalf("resumeTableIndex(%v, %q) = %d, want %d", tablesToSearch, c.afterTable, got, c.want)
+			}
+		})
+	}
+}
+
+// fakeRegexPage models one page of listKeysHandler's regex-search loop
+// against an in-memory stand-in for a per-table sorted Badger iterator, so
+// the table=all continuation logic can be exercised without a real store.
+func fakeRegexPage(tablesToSearch []string, keysByTable map[string][]string, keyRegEx *regexp.Regexp, afterTable, afterKey string, pageSize int) (matched []string, nextTable, nextKey string) {
+	resumeIndex := resumeTableIndex(tablesToSearch, afterTable)
+
+	for i, tablename := range tablesToSearch {
+		if resumeIndex >= 0 && i < resumeIndex {
+			continue
+		}
+
+		keys := append([]string(nil), keysByTable[tablename]...)
+		sort.Strings(keys)
+
+		start := 0
+		if resumeIndex >= 0 && i == resumeIndex && afterKey != "" {
+			for idx, k := range keys {
+				if k > afterKey {
+					break
+				}
+				start = idx + 1
+			}
+		}
+
+		for _, k := range keys[start:] {
+			if keyRegEx.MatchString(k) {
+				matched = append(matched, k)
+				if len(matched) >= pageSize {
+					return matched, tablename, k
+				}
+			}
+		}
+	}
+	return matched, "", ""
+}
+
+func TestListKeysRegexPaginationAcrossTables(t *testing.T) {
+	keysByTable := map[string][]string{
+		"watch":         {"/watch/a", "/watch/b", "/watch/c"},
+		"eventcount":    {"/eventcount/a", "/eventcount/b"},
+		"ressum":        {"/ressum/a"},
+		"watchactivity": {"/watchactivity/a", "/watchactivity/b"},
+	}
+	// Deliberately the fixed scan order used by table=all, not lexical order.
+	tablesToSearch := []string{"watch", "eventcount", "ressum", "watchactivity"}
+	keyRegEx := regexp.MustCompile(".*")
+
+	seen := make(map[string]bool)
+	afterTable, afterKey := "", ""
+	for page := 0; page < 20; page++ {
+		matched, nextTable, nextKey := fakeRegexPage(tablesToSearch, keysByTable, keyRegEx, afterTable, afterKey, 2)
+		for _, k := range matched {
+			if seen[k] {
+				t.Fatalf("key %q was returned on more than one page", k)
+			}
+			seen[k] = true
+		}
+		if nextTable == "" {
+			break
+		}
+		afterTable, afterKey = nextTable, nextKey
+	}
+
+	want := 0
+	for _, keys := range keysByTable {
+		want += len(keys)
+	}
+	if len(seen) != want {
+		t.Fatalf("expected %d total keys across all pages, got %d: %v", want, len(seen), seen)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2019, salesforce.com, inc.
+ * All rights reserved.
+ * SPDX-License-Identifier: BSD-3-Clause
+ * For full license text, see LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+ */
+
+package webserver
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/salesforce/sloop/pkg/sloop/store/typed"
+)
+
+const defaultMetricsCacheTTL = 60 * time.Second
+
+// computeKeyHistogramFn is a seam so tests can stub out the Badger scan.
+var computeKeyHistogramFn = computeKeyHistogram
+
+// metricsCache memoizes the result of computeKeyHistogram for ttl. Each
+// metricsHandler constructs its own, so the gauges aren't shared package state.
+type metricsCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	computedAt time.Time
+
+	badgerKeysTotal  *prometheus.GaugeVec
+	badgerBytesTotal *prometheus.GaugeVec
+}
+
+func newMetricsCache(ttl time.Duration) *metricsCache {
+	if ttl <= 0 {
+		ttl = defaultMetricsCacheTTL
+	}
+	return &metricsCache{
+		ttl: ttl,
+		badgerKeysTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sloop_badger_keys_total",
+			Help: "Number of Badger keys, broken out by sloop key dimensions.",
+		}, []string{"table", "partition", "group", "kind", "namespace"}),
+		badgerBytesTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sloop_badger_bytes_total",
+			Help: "Estimated size in bytes of Badger keys, broken out by sloop key dimensions.",
+		}, []string{"table", "partition", "group", "kind", "namespace"}),
+	}
+}
+
+func (c *metricsCache) refreshIfStale(tables typed.Tables) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.computedAt) < c.ttl {
+		return nil
+	}
+
+	result, _, _, err := computeKeyHistogramFn(context.Background(), tables, "")
+	if err != nil {
+		return err
+	}
+
+	c.badgerKeysTotal.Reset()
+	c.badgerBytesTotal.Reset()
+
+	for key, info := range result.HistogramMap {
+		labels := prometheus.Labels{
+			"table":     key.Table,
+			"partition": key.Partition,
+			"group":     key.Group,
+			"kind":      key.Kind,
+			"namespace": key.Namespace,
+		}
+		c.badgerKeysTotal.With(labels).Set(float64(info.TotalKeys))
+		c.badgerBytesTotal.With(labels).Set(float64(info.TotalSize))
+	}
+
+	c.setAggregateGauge(c.badgerKeysTotal, "internal", float64(result.TotalInternalKeys))
+	c.setAggregateGauge(c.badgerBytesTotal, "internal", float64(result.TotalInternalKeysSize))
+	c.setAggregateGauge(c.badgerKeysTotal, "head", float64(result.TotalHeadKeys))
+	c.setAggregateGauge(c.badgerKeysTotal, "move", float64(result.TotalMoveKeys))
+	c.setAggregateGauge(c.badgerKeysTotal, "discard", float64(result.TotalDiscardKeys))
+	c.setAggregateGauge(c.badgerKeysTotal, "deleted", float64(result.DeletedKeys))
+
+	c.computedAt = time.Now()
+	return nil
+}
+
+// setAggregateGauge records a count not tied to a single sloop key (internal, deleted, ...).
+func (c *metricsCache) setAggregateGauge(gauge *prometheus.GaugeVec, kind string, value float64) {
+	gauge.With(prometheus.Labels{
+		"table":     "",
+		"partition": "",
+		"group":     "",
+		"kind":      kind,
+		"namespace": "",
+	}).Set(value)
+}
+
+// metricsHandler exposes, as Prometheus gauges, the per-common.SloopKey key
+// counts and total sizes from the scan histogramHandler uses, plus the
+// internal, head, move, discard and deleted key counts and the internal key
+// size. The per-key minimum, maximum and average sizes are not exported.
+// ttl <= 0 falls back to defaultMetricsCacheTTL.
+func metricsHandler(tables typed.Tables, ttl time.Duration) http.HandlerFunc {
+	cache := newMetricsCache(ttl)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(cache.badgerKeysTotal, cache.badgerBytesTotal)
+	promHandler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if err := cache.refreshIfStale(tables); err != nil {
+			logWebError(err, "Could not compute badger key metrics", request, writer)
+			return
+		}
+		promHandler.ServeHTTP(writer, request)
+	}
+}
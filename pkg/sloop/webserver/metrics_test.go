@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2019, salesforce.com, inc.
+ * All rights reserved.
+ * SPDX-License-Identifier: BSD-3-Clause
+ * For full license text, see LICENSE.txt file in the repo root or https://opensource.org/licenses/BSD-3-Clause
+ */
+
+package webserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/salesforce/sloop/pkg/sloop/common"
+	"github.com/salesforce/sloop/pkg/sloop/store/typed"
+)
+
+func stubHistogram(h histogram) func(context.Context, typed.Tables, string) (histogram, bool, string, error) {
+	return func(context.Context, typed.Tables, string) (histogram, bool, string, error) {
+		return h, false, "", nil
+	}
+}
+
+func TestMetricsCacheRefreshIfStaleCaching(t *testing.T) {
+	orig := computeKeyHistogramFn
+	defer func() { computeKeyHistogramFn = orig }()
+
+	calls := 0
+	computeKeyHistogramFn = func(ctx context.Context, tables typed.Tables, prefix string) (histogram, bool, string, error) {
+		calls++
+		return histogram{}, false, "", nil
+	}
+
+	cache := newMetricsCache(50 * time.Millisecond)
+
+	if err := cache.refreshIfStale(nil); err != nil {
+		t.Fatalf("refreshIfStale: %v", err)
+	}
+	if err := cache.refreshIfStale(nil); err != nil {
+		t.Fatalf("refreshIfStale: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected a cached result within ttl, got %d scans", calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := cache.refreshIfStale(nil); err != nil {
+		t.Fatalf("refreshIfStale: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected a rescan once ttl elapsed, got %d scans", calls)
+	}
+}
+
+func TestMetricsCacheRefreshIfStalePopulatesLabels(t *testing.T) {
+	orig := computeKeyHistogramFn
+	defer func() { computeKeyHistogramFn = orig }()
+
+	key := common.SloopKey{Table: "watch", Partition: "p1", Group: "g1", Kind: "k1", Namespace: "n1"}
+	computeKeyHistogramFn = stubHistogram(histogram{
+		HistogramMap: map[common.SloopKey]*sloopKeyInfo{
+			key: {TotalKeys: 3, TotalSize: 40},
+		},
+		TotalInternalKeys: 1,
+		TotalHeadKeys:     2,
+	})
+
+	cache := newMetricsCache(time.Minute)
+	if err := cache.refreshIfStale(nil); err != nil {
+		t.Fatalf("refreshIfStale: %v", err)
+	}
+
+	if got := testutil.ToFloat64(cache.badgerKeysTotal.WithLabelValues("watch", "p1", "g1", "k1", "n1")); got != 3 {
+		t.Fatalf("badgerKeysTotal = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(cache.badgerBytesTotal.WithLabelValues("watch", "p1", "g1", "k1", "n1")); got != 40 {
+		t.Fatalf("badgerBytesTotal = %v, want 40", got)
+	}
+	if got := testutil.ToFloat64(cache.badgerKeysTotal.WithLabelValues("", "", "", "internal", "")); got != 1 {
+		t.Fatalf("internal gauge = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(cache.badgerKeysTotal.WithLabelValues("", "", "", "head", "")); got != 2 {
+		t.Fatalf("head gauge = %v, want 2", got)
+	}
+}
+
+func TestMetricsCacheGaugesAreNotShared(t *testing.T) {
+	c1 := newMetricsCache(time.Minute)
+	c2 := newMetricsCache(time.Minute)
+
+	if c1.badgerKeysTotal == c2.badgerKeysTotal {
+		t.Fatal("expected each metricsCache to own its own GaugeVec, got the same instance")
+	}
+
+	c1.badgerKeysTotal.WithLabelValues("watch", "p1", "g1", "k1", "n1").Set(5)
+	if got := testutil.ToFloat64(c2.badgerKeysTotal.WithLabelValues("watch", "p1", "g1", "k1", "n1")); got != 0 {
+		t.Fatalf("second metricsCache observed the first's gauge value: %v", got)
+	}
+}